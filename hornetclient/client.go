@@ -0,0 +1,232 @@
+// Package hornetclient is a small typed client for the subset of HORNET's
+// REST API (`/api/core/v2/peers`) the sidecar needs to reconcile peerings.
+// It wraps *http.Client with the TLS, authentication, timeout and retry
+// behaviour required to run against a real (non-lab) HORNET node instead of
+// talking plaintext HTTP with no auth.
+package hornetclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Peer is a single entry from HORNET's peer list, trimmed to the fields the
+// sidecar actually consumes.
+type Peer struct {
+	ID           string   `json:"id"`
+	Alias        string   `json:"alias,omitempty"`
+	MultiAddress []string `json:"multiAddress"`
+}
+
+// Config configures a Client. BaseURL should include the scheme, e.g.
+// "https://10.0.0.5:14265". CABundleFile, ClientCertFile and ClientKeyFile
+// are optional; when ClientCertFile/ClientKeyFile are both set, mTLS is
+// used. JWTTokenFile is optional; when set, its contents are sent as a
+// bearer token on every request.
+type Config struct {
+	BaseURL        string
+	CABundleFile   string
+	ClientCertFile string
+	ClientKeyFile  string
+	JWTTokenFile   string
+	Timeout        time.Duration
+	MaxRetries     int
+}
+
+// Client is a small, typed HORNET REST API client.
+type Client struct {
+	httpClient   *http.Client
+	baseURL      string
+	jwtTokenFile string
+	maxRetries   int
+}
+
+// New builds a Client from cfg, loading the CA bundle and client certificate
+// from disk up front so misconfiguration is caught at startup.
+func New(cfg Config) (*Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.CABundleFile != "" {
+		caBytes, err := os.ReadFile(cfg.CABundleFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read CA bundle %s", cfg.CABundleFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, errors.Errorf("no certificates found in CA bundle %s", cfg.CABundleFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" && cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load client certificate %s / key %s", cfg.ClientCertFile, cfg.ClientKeyFile)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		baseURL:      strings.TrimRight(cfg.BaseURL, "/"),
+		jwtTokenFile: cfg.JWTTokenFile,
+		maxRetries:   cfg.MaxRetries,
+	}, nil
+}
+
+// WithBaseURL returns a shallow copy of c pointed at a different base URL,
+// reusing the same underlying *http.Client (and therefore its TLS config
+// and connection pool). Callers use this to address the same HORNET REST
+// API across many different main pod IPs without re-reading TLS material
+// from disk for every target.
+func (c *Client) WithBaseURL(baseURL string) *Client {
+	clone := *c
+	clone.baseURL = strings.TrimRight(baseURL, "/")
+	return &clone
+}
+
+// ListPeers returns the peers currently known to the HORNET node.
+func (c *Client) ListPeers(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	if err := c.do(ctx, http.MethodGet, "/api/core/v2/peers", nil, 200, &peers); err != nil {
+		return nil, errors.Wrap(err, "failed to list peers")
+	}
+	return peers, nil
+}
+
+// AddPeer registers a new peering and returns the peer HORNET created.
+func (c *Client) AddPeer(ctx context.Context, multiAddress, alias string) (Peer, error) {
+	payload, err := json.Marshal(map[string]string{
+		"multiAddress": multiAddress,
+		"alias":        alias,
+	})
+	if err != nil {
+		return Peer{}, errors.Wrap(err, "failed to marshal add peer payload")
+	}
+	var peer Peer
+	if err := c.do(ctx, http.MethodPost, "/api/core/v2/peers", bytes.NewReader(payload), 200, &peer); err != nil {
+		return Peer{}, errors.Wrapf(err, "failed to add peer %s", alias)
+	}
+	return peer, nil
+}
+
+// RemovePeer deletes an existing peering by peer ID.
+func (c *Client) RemovePeer(ctx context.Context, peerID string) error {
+	path := fmt.Sprintf("/api/core/v2/peers/%s", peerID)
+	if err := c.do(ctx, http.MethodDelete, path, nil, 204, nil); err != nil {
+		return errors.Wrapf(err, "failed to remove peer %s", peerID)
+	}
+	return nil
+}
+
+// do executes a request with retry and exponential backoff with jitter,
+// decoding the response body into out (if non-nil) on the expected status
+// code. 4xx responses are not retried, since retrying a malformed request
+// never succeeds.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, wantStatus int, out interface{}) error {
+	var bodyBytes []byte
+	if body != nil {
+		var err error
+		bodyBytes, err = io.ReadAll(body)
+		if err != nil {
+			return errors.Wrap(err, "failed to buffer request body")
+		}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff(attempt))
+		}
+
+		var reqBody io.Reader
+		if bodyBytes != nil {
+			reqBody = bytes.NewReader(bodyBytes)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+		if err != nil {
+			return errors.Wrap(err, "failed to build request")
+		}
+		req.Header.Set("Accept", "application/json")
+		if bodyBytes != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if err := c.setAuth(req); err != nil {
+			return err
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = errors.Wrap(err, "request failed")
+			continue
+		}
+
+		resBytes, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			lastErr = errors.Wrap(err, "failed to read response body")
+			continue
+		}
+
+		if res.StatusCode != wantStatus {
+			lastErr = fmt.Errorf("unexpected status %d, body: %s", res.StatusCode, string(resBytes))
+			if res.StatusCode >= 400 && res.StatusCode < 500 {
+				return lastErr
+			}
+			continue
+		}
+
+		if out == nil || len(resBytes) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(resBytes, out); err != nil {
+			return errors.Wrap(err, "failed to decode response body")
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (c *Client) setAuth(req *http.Request) error {
+	if c.jwtTokenFile == "" {
+		return nil
+	}
+	token, err := os.ReadFile(c.jwtTokenFile)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read JWT token file %s", c.jwtTokenFile)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return nil
+}
+
+// backoff returns an exponential backoff duration for the given attempt
+// number (1-indexed), with up to 25% jitter to avoid every sidecar retrying
+// in lockstep against the same main node.
+func backoff(attempt int) time.Duration {
+	base := 200 * time.Millisecond * time.Duration(1<<uint(attempt-1))
+	if base > 5*time.Second {
+		base = 5 * time.Second
+	}
+	jitter := time.Duration(rand.Int63n(int64(base) / 4))
+	return base + jitter
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/eclipse-aerios/iota-tangle-peerer/hornetclient"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// runInformer watches main hornet pods via a SharedIndexInformer instead of
+// polling, driving reconcileTarget on Add/Update/Delete. The informer's own
+// resync period (refreshPeriod) re-delivers every known pod periodically,
+// which doubles as the safety net the old poll loop provided. Underlying
+// list/watch failures are surfaced through a WatchErrorHandler into
+// k8sPodListErrorsTotal. It blocks forever.
+func runInformer(k8sClient *kubernetes.Clientset, myNodeName, myPodNamespace, myPodName, iotaHornetSelector, mainNodeSelector, iotaHornetNs string, identity *identityHolder, hornetScheme string, hornetRestApiPort, minPeers, maxPeers int, refreshPeriod, retryPeriod, hornetCallTimeout time.Duration, sched *scheduler, hornetClient *hornetclient.Client) {
+	listWatch := cache.NewFilteredListWatchFromClient(
+		k8sClient.CoreV1().RESTClient(),
+		"pods",
+		iotaHornetNs,
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = iotaHornetSelector + "," + mainNodeSelector
+		},
+	)
+	informer := cache.NewSharedIndexInformer(listWatch, &corev1.Pod{}, refreshPeriod, cache.Indexers{})
+
+	onPodEvent := func(obj interface{}) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			return
+		}
+		reconcileTarget(myNodeName, myPodNamespace, myPodName, *pod, identity, hornetScheme, hornetRestApiPort, minPeers, maxPeers, refreshPeriod, retryPeriod, hornetCallTimeout, sched, informer.GetIndexer(), mainNodeSelector, hornetClient, k8sClient)
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onPodEvent,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			onPodEvent(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				pod, ok = tombstone.Obj.(*corev1.Pod)
+				if !ok {
+					return
+				}
+			}
+			fmt.Printf("Main hornet pod %s removed, dropping its peering state\n", pod.Name)
+			sched.remove(pod.Name)
+		},
+	})
+
+	if err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		fmt.Fprintf(os.Stderr, "Main hornet pod informer list/watch error: %s\n", err.Error())
+		k8sPodListErrorsTotal.Inc()
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set main hornet pod informer watch error handler, err: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	stopCh := make(chan struct{})
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		fmt.Fprintf(os.Stderr, "Failed to sync main hornet pod informer cache\n")
+		os.Exit(1)
+	}
+	fmt.Println("Main hornet pod informer synced, watching for changes")
+	<-stopCh
+}
+
+// reconcileTarget reconciles the peering for a single main hornet pod. It is
+// driven by the informer on every Add/Update event, including the periodic
+// resync, rather than a fixed poll loop. sched.recordSuccess/recordFailure
+// are the source of truth /healthz and /readyz read from (see serveMetrics);
+// a target that is permanently failing must never make them report healthy.
+func reconcileTarget(myNodeName, myPodNamespace, myPodName string, pod corev1.Pod, identity *identityHolder, hornetScheme string, hornetRestApiPort, minPeers, maxPeers int, refreshPeriod, retryPeriod, hornetCallTimeout time.Duration, sched *scheduler, indexer cache.Indexer, mainNodeSelector string, hornetClient *hornetclient.Client, k8sClient *kubernetes.Clientset) {
+	if pod.Spec.NodeName == myNodeName {
+		// We are running on a main node ourselves, never peer with it.
+		return
+	}
+	matching := indexer.List()
+	if len(matching) < minPeers {
+		fmt.Fprintf(os.Stderr, "Only %d main pods match selector %s, want at least %d\n", len(matching), mainNodeSelector, minPeers)
+	}
+	if maxPeers > 0 && sched.countTracked() >= maxPeers && !sched.isTracked(pod.Name) {
+		fmt.Fprintf(os.Stderr, "Already tracking %d main pods (max-peers=%d), skipping %s\n", sched.countTracked(), maxPeers, pod.Name)
+		return
+	}
+	if pod.Status.PodIP == "" {
+		sched.recordFailure(pod.Name, "", "main hornet pod has no IP", retryPeriod)
+		return
+	}
+	if !sched.ready(pod.Name) {
+		return
+	}
+
+	podClient := hornetClient.WithBaseURL(fmt.Sprintf("%s://%s:%d", hornetScheme, pod.Status.PodIP, hornetRestApiPort))
+	ok, err := tryPeering(myNodeName, pod, identity.Get(), podClient, k8sClient, myPodNamespace, myPodName, hornetCallTimeout)
+	if !ok {
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		reconcileTotal.WithLabelValues("failure").Inc()
+		sched.recordFailure(pod.Name, pod.Status.PodIP, errMsg, retryPeriod)
+		return
+	}
+	reconcileTotal.WithLabelValues("success").Inc()
+	sched.recordSuccess(pod.Name, pod.Status.PodIP, refreshPeriod)
+	peeringCurrentEstablished.Set(float64(countPeered(sched.snapshot())))
+}
@@ -0,0 +1,152 @@
+// Package keystore persists this sidecar's Ed25519 peer identity in a
+// Kubernetes Secret instead of requiring an external init-container to seed
+// a PEM file on disk, and can optionally rotate that identity on a
+// schedule.
+package keystore
+
+import (
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const privateKeySecretKey = "private-key.pem"
+
+// Keystore loads and persists an Ed25519 private key from a single
+// Kubernetes Secret named secretName in namespace.
+type Keystore struct {
+	k8sClient  *kubernetes.Clientset
+	namespace  string
+	secretName string
+}
+
+// New builds a Keystore backed by the Secret namespace/secretName.
+func New(k8sClient *kubernetes.Clientset, namespace, secretName string) *Keystore {
+	return &Keystore{k8sClient: k8sClient, namespace: namespace, secretName: secretName}
+}
+
+// LoadOrCreate reads the private key from the Secret if it exists, or
+// generates a fresh Ed25519 keypair, PEM-encodes it (PKCS8) and creates the
+// Secret with owner set to ownerRef, so it is cleaned up alongside whatever
+// controls this pod.
+func (k *Keystore) LoadOrCreate(ctx context.Context, ownerRef metav1.OwnerReference) (ed25519.PrivateKey, error) {
+	secret, err := k.k8sClient.CoreV1().Secrets(k.namespace).Get(ctx, k.secretName, metav1.GetOptions{})
+	if err == nil {
+		return decodePrivateKey(secret.Data[privateKeySecretKey])
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get identity secret %s/%s", k.namespace, k.secretName)
+	}
+
+	privKey, pemBytes, err := generatePEMKeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate identity keypair")
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            k.secretName,
+			Namespace:       k.namespace,
+			OwnerReferences: []metav1.OwnerReference{ownerRef},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			privateKeySecretKey: pemBytes,
+		},
+	}
+	if _, err := k.k8sClient.CoreV1().Secrets(k.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return nil, errors.Wrapf(err, "failed to create identity secret %s/%s", k.namespace, k.secretName)
+	}
+	return privKey, nil
+}
+
+// Rotate generates a fresh Ed25519 keypair, persists it in place of the
+// current one, and returns the new key. Callers are responsible for
+// publishing the new identity (e.g. as a pod annotation) and tearing down
+// any peering established under the old one.
+func (k *Keystore) Rotate(ctx context.Context) (ed25519.PrivateKey, error) {
+	privKey, pemBytes, err := generatePEMKeyPair()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate rotated identity keypair")
+	}
+	secret, err := k.k8sClient.CoreV1().Secrets(k.namespace).Get(ctx, k.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get identity secret %s/%s for rotation", k.namespace, k.secretName)
+	}
+	secret.Data[privateKeySecretKey] = pemBytes
+	if _, err := k.k8sClient.CoreV1().Secrets(k.namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return nil, errors.Wrapf(err, "failed to update identity secret %s/%s for rotation", k.namespace, k.secretName)
+	}
+	return privKey, nil
+}
+
+// RunRotation rotates the identity every interval, calling onRotate with
+// each newly generated key. It blocks; callers should run it in a
+// goroutine. A rotation failure is passed to onRotate as its error argument
+// and does not stop subsequent attempts.
+func (k *Keystore) RunRotation(ctx context.Context, interval time.Duration, onRotate func(ed25519.PrivateKey, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			privKey, err := k.Rotate(ctx)
+			onRotate(privKey, err)
+		}
+	}
+}
+
+// ControllerOwnerReference returns the OwnerReference pointing at pod's
+// controller (e.g. its DaemonSet), so a Secret created for pod can be owned
+// by the same controller rather than by the pod itself, which would be
+// deleted and recreated far more often.
+func ControllerOwnerReference(pod *corev1.Pod) (metav1.OwnerReference, error) {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			return ref, nil
+		}
+	}
+	return metav1.OwnerReference{}, errors.Errorf("pod %s/%s has no controller owner reference", pod.Namespace, pod.Name)
+}
+
+func generatePEMKeyPair() (ed25519.PrivateKey, []byte, error) {
+	_, privKey, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate Ed25519 keypair")
+	}
+	pkcs8Bytes, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal private key as PKCS8")
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: pkcs8Bytes,
+	})
+	return privKey, pemBytes, nil
+}
+
+func decodePrivateKey(pemBytes []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("unable to decode private key PEM from identity secret")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse private key from identity secret")
+	}
+	privKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("identity secret does not contain an Ed25519 private key")
+	}
+	return privKey, nil
+}
@@ -1,36 +1,87 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/x509"
-	"encoding/json"
+	"encoding/base64"
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/caarlos0/env/v9"
+	"github.com/eclipse-aerios/iota-tangle-peerer/hornetclient"
+	"github.com/eclipse-aerios/iota-tangle-peerer/keystore"
 	libp2pcrypto "github.com/libp2p/go-libp2p/core/crypto"
 	libp2ppeer "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/record"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
+// peerRecordAnnotation is the pod annotation we publish our signed
+// peer.PeerRecord envelope under.
+//
+// Scope note: HORNET's REST API (POST /peers) takes only a bare multiaddress
+// and alias string, with no field for an envelope, so there is no way to
+// make the main HORNET node itself verify our signature before accepting a
+// peering — that would require the external HORNET binary to speak libp2p
+// identify, which is out of scope for a sidecar that only talks REST to it.
+// What tryPeering actually gets out of this annotation is narrower: reading
+// it back over a real k8s API round trip confirms what's externally
+// observable matches our current identity, catching a silently failed or
+// stale publish before we hand that identity to HORNET.
+const peerRecordAnnotation = "iota-tangle-peerer.eclipse-aerios.io/peer-record"
+
 type envConfig struct {
-	MyNodeName string `env:"MY_NODE_NAME,notEmpty"`
-	MyIP       string `env:"MY_IP,notEmpty"`
+	MyNodeName     string `env:"MY_NODE_NAME,notEmpty"`
+	MyIP           string `env:"MY_IP,notEmpty"`
+	MyPodName      string `env:"MY_POD_NAME,notEmpty"`
+	MyPodNamespace string `env:"MY_POD_NAMESPACE,notEmpty"`
+}
+
+// peerIdentity bundles the multiaddress we advertise to HORNET together with
+// the libp2p peer ID and the signed, envelope-wrapped peer.PeerRecord we
+// publish for it (see peerRecordAnnotation for what that envelope can and
+// can't prove). PreviousPeerID is set after an identity rotation so
+// tryPeering can clean up the peering established under the old identity.
+type peerIdentity struct {
+	Multiaddress   string
+	PeerID         libp2ppeer.ID
+	Envelope       []byte
+	PreviousPeerID *libp2ppeer.ID
+}
+
+// identityHolder lets the rotation goroutine swap in a new peerIdentity
+// while the informer-driven reconciler keeps reading the current one.
+type identityHolder struct {
+	mu      sync.RWMutex
+	current peerIdentity
+}
+
+func (h *identityHolder) Get() peerIdentity {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.current
+}
+
+func (h *identityHolder) Set(identity peerIdentity) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current = identity
 }
 
 func main() {
 	fmt.Println("Starting")
-	var mainNodeName string
+	var mainNodeSelector string
 	var iotaHornetSelector string
 	var iotaHornetNs string
 	var privateKeyFile string
@@ -38,8 +89,21 @@ func main() {
 	var retryPeriod time.Duration
 	var hornetRestApiPort int
 	var gossipProtocolPort int
+	var minPeers int
+	var maxPeers int
+	var statusAddr string
+	var metricsAddr string
+	var hornetUseTLS bool
+	var hornetCAFile string
+	var hornetClientCertFile string
+	var hornetClientKeyFile string
+	var hornetJWTTokenFile string
+	var hornetRequestTimeout time.Duration
+	var hornetMaxRetries int
+	var identitySecret string
+	var identityRotationPeriod time.Duration
 
-	flag.StringVar(&mainNodeName, "main-node-name", "", "Name of k8s node hosting main hornet pod")
+	flag.StringVar(&mainNodeSelector, "main-node-selector", "", "label selector matching one or more main hornet pods to peer against")
 	flag.StringVar(&iotaHornetSelector, "iota-hornet-selector", "", "label selector for iota-hornet daemonset")
 	flag.StringVar(&iotaHornetNs, "iota-hornet-ns", "", "namespace with iota-hornet daemonset")
 	flag.StringVar(&privateKeyFile, "private-key-file", "", "path to private key file of this hornet node")
@@ -47,6 +111,19 @@ func main() {
 	flag.DurationVar(&retryPeriod, "retry-period", 5*time.Second, "Period between retries of peering estabilishment. In go duration format. Default: 5s")
 	flag.IntVar(&hornetRestApiPort, "hornet-rest-api-port", 14265, "Port on which main node's hornet rest API is exposed. Default: 14265")
 	flag.IntVar(&gossipProtocolPort, "gossip-protocol-port", 15600, "Port of hornet gossip protocol. Included in multiaddress. Default: 15600")
+	flag.IntVar(&minPeers, "min-peers", 1, "Minimum number of main hornet pods we expect to peer with; logged as a warning when unmet. Default: 1")
+	flag.IntVar(&maxPeers, "max-peers", 0, "Maximum number of matching main hornet pods to peer with concurrently, 0 means no limit. Default: 0")
+	flag.StringVar(&statusAddr, "status-addr", ":8080", "Address the /status endpoint is served on. Default: :8080")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":9090", "Address the /metrics, /healthz and /readyz endpoints are served on. Default: :9090")
+	flag.BoolVar(&hornetUseTLS, "hornet-use-tls", false, "Speak HTTPS instead of plaintext HTTP to the HORNET REST API. Default: false")
+	flag.StringVar(&hornetCAFile, "hornet-ca-file", "", "path to a PEM CA bundle used to verify the HORNET REST API's server certificate")
+	flag.StringVar(&hornetClientCertFile, "hornet-client-cert-file", "", "path to a PEM client certificate for mTLS against the HORNET REST API")
+	flag.StringVar(&hornetClientKeyFile, "hornet-client-key-file", "", "path to the PEM private key matching hornet-client-cert-file")
+	flag.StringVar(&hornetJWTTokenFile, "hornet-jwt-token-file", "", "path to a file containing a JWT bearer token for the HORNET REST API")
+	flag.DurationVar(&hornetRequestTimeout, "hornet-request-timeout", 10*time.Second, "Per-request timeout against the HORNET REST API. Default: 10s")
+	flag.IntVar(&hornetMaxRetries, "hornet-max-retries", 3, "Number of retries with exponential backoff for HORNET REST API requests. Default: 3")
+	flag.StringVar(&identitySecret, "identity-secret", "", "name of a k8s Secret in our own namespace to load/persist our Ed25519 peer identity in, instead of private-key-file. When set, the Secret is created if it does not already exist")
+	flag.DurationVar(&identityRotationPeriod, "identity-rotation-period", 0, "Period on which to rotate our Ed25519 peer identity when identity-secret is set, 0 disables rotation. Default: 0")
 	flag.Parse()
 
 	envCfg := envConfig{}
@@ -54,8 +131,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to parse env variables: %s\n", err.Error())
 	}
 	fmt.Println("Loaded env and flags")
-	if mainNodeName == "" {
-		fmt.Fprintf(os.Stderr, "mainNodeName not specified\n")
+	if mainNodeSelector == "" {
+		fmt.Fprintf(os.Stderr, "mainNodeSelector not specified\n")
 		os.Exit(1)
 	}
 	if iotaHornetSelector == "" {
@@ -66,19 +143,12 @@ func main() {
 		fmt.Fprintf(os.Stderr, "iotaHornetNs not specified\n")
 		os.Exit(1)
 	}
-	if privateKeyFile == "" {
-		fmt.Fprintf(os.Stderr, "privateKeyFile not specified\n")
+	if privateKeyFile == "" && identitySecret == "" {
+		fmt.Fprintf(os.Stderr, "one of privateKeyFile or identitySecret must be specified\n")
 		os.Exit(1)
 	}
 	fmt.Println("validated flags")
 
-	if mainNodeName == envCfg.MyNodeName {
-		fmt.Fprintf(os.Stderr, "Is main node, not running\n")
-		for {
-			time.Sleep(10000 * time.Hour)
-		}
-	}
-
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load k8s inClusterConfig, is container ran outside cluster? err: %s\n", err.Error())
@@ -89,21 +159,128 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Failed to create clientSet for k8s cluster config, err: %s\n", err.Error())
 		os.Exit(1)
 	}
-	multiaddress, err := calculateMultiaddress(privateKeyFile, envCfg.MyIP, gossipProtocolPort)
+	var ks *keystore.Keystore
+	var privKey ed25519.PrivateKey
+	if identitySecret != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		pod, err := k8sClient.CoreV1().Pods(envCfg.MyPodNamespace).Get(ctx, envCfg.MyPodName, metav1.GetOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get own pod %s/%s, err: %s\n", envCfg.MyPodNamespace, envCfg.MyPodName, err.Error())
+			os.Exit(1)
+		}
+		ownerRef, err := keystore.ControllerOwnerReference(pod)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to determine owner reference for identity secret, err: %s\n", err.Error())
+			os.Exit(1)
+		}
+		ks = keystore.New(k8sClient, envCfg.MyPodNamespace, identitySecret)
+		privKey, err = ks.LoadOrCreate(ctx, ownerRef)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load or create identity secret %s, err: %s\n", identitySecret, err.Error())
+			os.Exit(1)
+		}
+	} else {
+		var err error
+		privKey, err = waitForEd25519PrivateKeyFromPEMFile(privateKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load private key, err: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	initialIdentity, err := buildPeerIdentity(privKey, envCfg.MyIP, gossipProtocolPort, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to construct multiaddress, err: %s\n", err.Error())
 		os.Exit(1)
 	}
-	fmt.Printf("Multiaddress is %s\n", multiaddress)
+	fmt.Printf("Multiaddress is %s, peer ID is %s\n", initialIdentity.Multiaddress, initialIdentity.PeerID)
+	identity := &identityHolder{}
+	identity.Set(initialIdentity)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := publishPeerRecordEnvelope(ctx, k8sClient, envCfg.MyPodNamespace, envCfg.MyPodName, initialIdentity.Envelope); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to publish peer record envelope on pod %s/%s, err: %s\n", envCfg.MyPodNamespace, envCfg.MyPodName, err.Error())
+	}
+	cancel()
+
+	if ks != nil && identityRotationPeriod > 0 {
+		go ks.RunRotation(context.Background(), identityRotationPeriod, func(newPrivKey ed25519.PrivateKey, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to rotate peer identity, err: %s\n", err.Error())
+				return
+			}
+			previous := identity.Get()
+			rotated, err := buildPeerIdentity(newPrivKey, envCfg.MyIP, gossipProtocolPort, &previous.PeerID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to build rotated peer identity, err: %s\n", err.Error())
+				return
+			}
+			identity.Set(rotated)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := publishPeerRecordEnvelope(ctx, k8sClient, envCfg.MyPodNamespace, envCfg.MyPodName, rotated.Envelope); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to publish rotated peer record envelope, err: %s\n", err.Error())
+			}
+			fmt.Printf("Rotated peer identity, old peer ID %s, new peer ID %s\n", previous.PeerID, rotated.PeerID)
+		})
+	}
+
+	hornetClient, err := hornetclient.New(hornetclient.Config{
+		CABundleFile:   hornetCAFile,
+		ClientCertFile: hornetClientCertFile,
+		ClientKeyFile:  hornetClientKeyFile,
+		JWTTokenFile:   hornetJWTTokenFile,
+		Timeout:        hornetRequestTimeout,
+		MaxRetries:     hornetMaxRetries,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to build HORNET REST API client, err: %s\n", err.Error())
+		os.Exit(1)
+	}
+	hornetScheme := "http"
+	if hornetUseTLS {
+		hornetScheme = "https"
+	}
+	// Per-hornetClient-call budget tryPeering uses for each of ListPeers,
+	// RemovePeer and AddPeer individually: enough for every configured
+	// hornetClient retry to run to completion, not a fixed constant that
+	// would silently cancel a call before its retry budget is used.
+	hornetCallTimeout := hornetRequestTimeout * time.Duration(hornetMaxRetries+1)
+	// Plus the worst-case backoff hornetclient sleeps between attempts:
+	// 200ms doubling per retry, capped at 5s, plus up to 25% jitter.
+	retryWait := 200 * time.Millisecond
+	for attempt := 1; attempt <= hornetMaxRetries; attempt++ {
+		hornetCallTimeout += retryWait + retryWait/4
+		if retryWait < 5*time.Second {
+			retryWait = min(2*retryWait, 5*time.Second)
+		}
+	}
 
-	for ; ; time.Sleep(refreshPeriod) {
-		for done := false; !done; time.Sleep(retryPeriod) {
-			done = tryPeering(k8sClient, envCfg.MyNodeName, mainNodeName, iotaHornetSelector, iotaHornetNs, multiaddress, hornetRestApiPort)
+	sched := newScheduler()
+	go serveStatus(statusAddr, sched, minPeers)
+	go serveMetrics(metricsAddr, sched, minPeers)
+
+	// runInformer watches main hornet pods instead of polling, reacting to
+	// Add/Update/Delete almost instantly, with its own resync period acting
+	// as the safety net the old poll loop used to provide.
+	runInformer(k8sClient, envCfg.MyNodeName, envCfg.MyPodNamespace, envCfg.MyPodName, iotaHornetSelector, mainNodeSelector, iotaHornetNs, identity, hornetScheme, hornetRestApiPort, minPeers, maxPeers, refreshPeriod, retryPeriod, hornetCallTimeout, sched, hornetClient)
+}
+
+func countPeered(targets []targetState) int {
+	count := 0
+	for _, t := range targets {
+		if t.Peered {
+			count++
 		}
 	}
+	return count
 }
 
-func calculateMultiaddress(privateKeyFile, myIp string, gossipProtocolPort int) (string, error) {
+// waitForEd25519PrivateKeyFromPEMFile blocks until privateKeyFile exists
+// (typically seeded by an init container) and loads the Ed25519 private key
+// from it.
+func waitForEd25519PrivateKeyFromPEMFile(privateKeyFile string) (ed25519.PrivateKey, error) {
 	for {
 		if _, err := os.Stat(privateKeyFile); !os.IsNotExist(err) {
 			break
@@ -111,21 +288,54 @@ func calculateMultiaddress(privateKeyFile, myIp string, gossipProtocolPort int)
 		fmt.Printf("Waiting for file %s to be created\n", privateKeyFile)
 		time.Sleep(5 * time.Second)
 	}
-	// private key already exists, load and return it
 	privKey, err := readEd25519PrivateKeyFromPEMFile(privateKeyFile)
 	if err != nil {
-		return "", errors.Wrapf(err, "unable to load Ed25519 private key for peer identity")
+		return nil, errors.Wrapf(err, "unable to load Ed25519 private key for peer identity")
 	}
+	return privKey, nil
+}
+
+// buildPeerIdentity derives the multiaddress we advertise to HORNET from
+// privKey and seals a signed peer.PeerRecord envelope for it, so we have
+// something to publish and self-check (see peerRecordAnnotation).
+// previousPeerID is carried through onto the returned identity so tryPeering
+// can clean up a peering established under a pre-rotation identity; pass nil
+// when there is none.
+func buildPeerIdentity(privKey ed25519.PrivateKey, myIp string, gossipProtocolPort int, previousPeerID *libp2ppeer.ID) (peerIdentity, error) {
 	libp2pPrivKey, _, err := libp2pcrypto.KeyPairFromStdKey(&privKey)
 	if err != nil {
-		return "", errors.Wrapf(err, "Failed to get libp2pkey from ed25519 key")
+		return peerIdentity{}, errors.Wrapf(err, "Failed to get libp2pkey from ed25519 key")
 	}
 	peerID, err := libp2ppeer.IDFromPrivateKey(libp2pPrivKey)
 	if err != nil {
-		return "", errors.Wrapf(err, "Failed to get Peer ID from private key")
+		return peerIdentity{}, errors.Wrapf(err, "Failed to get Peer ID from private key")
 	}
 	multiaddress := fmt.Sprintf("/ip4/%s/tcp/%d/p2p/%s", myIp, gossipProtocolPort, peerID)
-	return multiaddress, nil
+
+	transportAddr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/%d", myIp, gossipProtocolPort))
+	if err != nil {
+		return peerIdentity{}, errors.Wrapf(err, "Failed to construct transport multiaddr for peer record")
+	}
+	peerRecord := &libp2ppeer.PeerRecord{
+		PeerID: peerID,
+		Addrs:  []ma.Multiaddr{transportAddr},
+		Seq:    uint64(time.Now().UnixNano()),
+	}
+	envelope, err := record.Seal(peerRecord, libp2pPrivKey)
+	if err != nil {
+		return peerIdentity{}, errors.Wrapf(err, "Failed to seal peer record envelope")
+	}
+	envelopeBytes, err := envelope.Marshal()
+	if err != nil {
+		return peerIdentity{}, errors.Wrapf(err, "Failed to marshal peer record envelope")
+	}
+
+	return peerIdentity{
+		Multiaddress:   multiaddress,
+		PeerID:         peerID,
+		Envelope:       envelopeBytes,
+		PreviousPeerID: previousPeerID,
+	}, nil
 }
 
 // ReadEd25519PrivateKeyFromPEMFile reads an Ed25519 private key from a file with PEM format.
@@ -154,151 +364,164 @@ func readEd25519PrivateKeyFromPEMFile(filepath string) (ed25519.PrivateKey, erro
 	return privKey, nil
 }
 
-func tryPeering(k8sClient *kubernetes.Clientset, myNodeName, mainNodeName, iotaHornetSelector, iotaHornetNs, multiaddress string, hornetRestApiPort int) bool {
-	fmt.Println("Getting main hornet node")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	podList, err := k8sClient.CoreV1().Pods(iotaHornetNs).List(ctx, metav1.ListOptions{
-		LabelSelector: iotaHornetSelector,
-		FieldSelector: "spec.nodeName=" + mainNodeName,
-	})
+// publishPeerRecordEnvelope stamps our own pod with the signed peer record
+// envelope so tryPeering (and anything else watching this pod) can recover
+// a verified identity instead of trusting pod metadata alone.
+func publishPeerRecordEnvelope(ctx context.Context, k8sClient *kubernetes.Clientset, namespace, podName string, envelope []byte) error {
+	patch := []byte(fmt.Sprintf(
+		`{"metadata":{"annotations":{%q:%q}}}`,
+		peerRecordAnnotation, base64.StdEncoding.EncodeToString(envelope),
+	))
+	_, err := k8sClient.CoreV1().Pods(namespace).Patch(ctx, podName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// verifyPeerRecordEnvelope unmarshals and verifies a signed peer record
+// envelope, returning the peer ID it vouches for. This only checks the
+// envelope's own signature; it has no way to make HORNET itself verify
+// anything (see peerRecordAnnotation).
+func verifyPeerRecordEnvelope(envelopeBytes []byte) (libp2ppeer.ID, error) {
+	envelope, untyped, err := record.ConsumeEnvelope(envelopeBytes, libp2ppeer.PeerRecordEnvelopeDomain)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to list pods matching labels %s and nodeName %s, err: %s\n", iotaHornetSelector, mainNodeName, err.Error())
-		return false
-	}
-	if len(podList.Items) != 1 {
-		fmt.Fprintf(os.Stderr, "There is not exactly 1 main hornet pod (%d exist), will try again later\n", len(podList.Items))
-		return false
+		return "", errors.Wrapf(err, "failed to verify peer record envelope signature")
 	}
-	mainHornet := podList.Items[0]
-	mainHornetIP := mainHornet.Status.PodIP
-	if mainHornetIP == "" {
-		fmt.Fprintf(os.Stderr, "Main hornet pod has no IP, will try again later\n")
-		return false
+	peerRecord, ok := untyped.(*libp2ppeer.PeerRecord)
+	if !ok {
+		return "", errors.New("envelope did not contain a peer record")
 	}
-	fmt.Println("Checking current peers")
-	url := fmt.Sprintf("http://%s:%d/api/core/v2/peers", mainHornetIP, hornetRestApiPort)
-
-	req, err := http.NewRequest("GET", url, nil)
+	_ = envelope
+	return peerRecord.PeerID, nil
+}
 
+// fetchPeerRecordEnvelope reads back the signed peer record envelope
+// published on our own pod (see publishPeerRecordEnvelope), so tryPeering can
+// self-check the identity the cluster can actually observe rather than the
+// in-memory copy we happen to be holding. It does not, and cannot, make
+// HORNET verify anything — see peerRecordAnnotation for why.
+func fetchPeerRecordEnvelope(ctx context.Context, k8sClient *kubernetes.Clientset, namespace, podName string) ([]byte, error) {
+	pod, err := k8sClient.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to build get to main node, will try again later, err: %s\n", err.Error())
-		return false
+		return nil, errors.Wrapf(err, "failed to get own pod %s/%s", namespace, podName)
 	}
-	req.Header.Add("Accept", "application/json")
-
-	res, err := http.DefaultClient.Do(req)
+	encoded, ok := pod.Annotations[peerRecordAnnotation]
+	if !ok {
+		return nil, errors.Errorf("pod %s/%s has no %s annotation published", namespace, podName, peerRecordAnnotation)
+	}
+	envelope, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get main node peers, will try again later, err: %s\n", err.Error())
-		return false
+		return nil, errors.Wrapf(err, "failed to decode %s annotation", peerRecordAnnotation)
 	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		fmt.Fprintf(os.Stderr, "Unexpected status when getting main node peers: %d, body: %s, will try again later\n", res.StatusCode, readBody(res.Body))
-		return false
+	return envelope, nil
+}
+
+// tryPeering reconciles a single peering between us and mainPod, talking to
+// its HORNET REST API through client. It returns ok=false with a
+// descriptive error whenever the caller should back off and retry this
+// specific target later; it never touches any other target. callTimeout
+// must be derived from the client's configured per-request timeout and
+// retry count, so a slower hornet-request-timeout or a larger
+// hornet-max-retries isn't cut short by an unrelated fixed deadline. Each
+// hornetClient call in the pass (ListPeers, the pre-rotation RemovePeer,
+// any stale-multiaddress RemovePeer, AddPeer) gets its own fresh
+// context.WithTimeout(callTimeout): a single shared deadline across the
+// whole pass would let an earlier call that burned its retry budget starve
+// every call after it of the retries they're configured for.
+func tryPeering(myNodeName string, mainPod corev1.Pod, identity peerIdentity, client *hornetclient.Client, k8sClient *kubernetes.Clientset, podNamespace, podName string, callTimeout time.Duration) (bool, error) {
+	// Fetch our own published envelope back from the API server and verify
+	// it, rather than re-verifying the in-memory copy we just sealed
+	// ourselves: this actually exercises the publish path and catches a
+	// silently failed or stale publish (e.g. a rotation whose annotation
+	// update hasn't landed yet) before we hand the identity to the main node.
+	// This is a self-check of our own publish, not an identify-protocol
+	// exchange with the main node — HORNET's REST API (POST /peers) has no
+	// field for an envelope, so it cannot be made to verify our signature
+	// itself. See peerRecordAnnotation for the full scope note.
+	verifyCtx, verifyCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	publishedEnvelope, err := fetchPeerRecordEnvelope(verifyCtx, k8sClient, podNamespace, podName)
+	verifyCancel()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to fetch published peer record envelope")
 	}
-	bodyBytes, err := io.ReadAll(res.Body)
+	verifiedPeerID, err := verifyPeerRecordEnvelope(publishedEnvelope)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to read get response body, will try again later, err: %s\n", err.Error())
-		return false
+		return false, errors.Wrap(err, "failed to verify published peer record envelope")
+	}
+	if verifiedPeerID != identity.PeerID {
+		return false, fmt.Errorf("published peer record envelope vouches for %s but current identity is %s, publish may be stale", verifiedPeerID, identity.PeerID)
 	}
 
-	var peers []map[string]interface{}
-	err = json.Unmarshal(bodyBytes, &peers)
+	fmt.Printf("Checking current peers of main pod %s\n", mainPod.Name)
+	listCtx, listCancel := context.WithTimeout(context.Background(), callTimeout)
+	start := time.Now()
+	peers, err := client.ListPeers(listCtx)
+	httpRequestDuration.WithLabelValues("list").Observe(time.Since(start).Seconds())
+	listCancel()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to parse get peers response, will try again later, err: %s\n", err.Error())
-		return false
+		return false, errors.Wrapf(err, "failed to list peers on main pod %s", mainPod.Name)
 	}
-	fmt.Println("Gathered current peers")
-	for _, peer := range peers {
-		if alias, ok := peer["alias"].(string); ok && alias == myNodeName {
-			fmt.Println("Already peered with main node, checking if valid peerID")
-			multiaddressInMain, ok := getMultiaddressFromPeer(peer)
-			if !ok {
-				fmt.Fprintf(os.Stderr, "Multiaddress not found in peer corresponding to this node (%s) in get peers response. Will try again later.\n", alias)
-				return false
-			}
-			peerIdInMain, ok := peer["id"].(string)
-			if !ok {
-				fmt.Fprintf(os.Stderr, "PeerID not found in peer corresponding to this node (%s) in get peers response. Will try again later.\n", alias)
-				return false
-			}
-			fullMultiInMain := multiaddressInMain + "/p2p/" + peerIdInMain
-			if fullMultiInMain == multiaddress {
-				return true
-			}
-			fmt.Printf("Multiaddress in main node is stale (my (%s) != in main (%s)), deleting old peering\n", multiaddress, fullMultiInMain)
-			url := fmt.Sprintf("http://%s:%d/api/core/v2/peers/%s", mainHornetIP, hornetRestApiPort, peerIdInMain)
-			req, err := http.NewRequest("DELETE", url, nil)
+	fmt.Printf("Gathered current peers of main pod %s\n", mainPod.Name)
 
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to build delete peering request, will try again later, err: %s\n", err.Error())
-				return false
+	// Clean up any pre-rotation peering in its own pass, before matching the
+	// current identity below. HORNET's peer list order is unspecified, and
+	// the current-identity match below returns as soon as it finds a valid
+	// peering, so interleaving the two in a single pass could short-circuit
+	// before the stale entry was ever reached.
+	if identity.PreviousPeerID != nil {
+		for _, peer := range peers {
+			if peer.ID != identity.PreviousPeerID.String() {
+				continue
 			}
-			res, err := http.DefaultClient.Do(req)
+			fmt.Printf("Peering on main pod %s was established under our pre-rotation peer ID (%s), deleting it\n", mainPod.Name, peer.ID)
+			// Each hornetClient call gets its own callTimeout budget: if
+			// ListPeers above burned through retries on a slow/flaky HORNET,
+			// this delete must not inherit an already-expired deadline.
+			deleteCtx, deleteCancel := context.WithTimeout(context.Background(), callTimeout)
+			start := time.Now()
+			err := client.RemovePeer(deleteCtx, peer.ID)
+			httpRequestDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+			deleteCancel()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to delete old peering, will try again later, err: %s\n", err.Error())
-				return false
+				return false, errors.Wrapf(err, "failed to delete pre-rotation peering on main pod %s", mainPod.Name)
 			}
-			defer res.Body.Close()
-
-			if res.StatusCode != 204 {
-				fmt.Fprintf(os.Stderr, "Unexpected status when deleting old peering id: %d, body: %s will try again later\n", res.StatusCode, readBody(res.Body))
-				return false
-			}
-			fmt.Println("Old peering deleted")
+			peeringStaleDeletionsTotal.Inc()
+			break
 		}
 	}
-	fmt.Println("Establishing peering")
-	payload, _ := json.Marshal(map[string]string{
-		"multiAddress": multiaddress,
-		"alias":        myNodeName,
-	})
-
-	req, err = http.NewRequest("POST", url, bytes.NewBuffer(payload))
-
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to build peering request, will try again later, err: %s\n", err.Error())
-		return false
-	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Accept", "application/json")
 
-	res, err = http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to post peering request, will try again later, err: %s\n", err.Error())
-		return false
-	}
-	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		fmt.Fprintf(os.Stderr, "Unexpected status when getting main node peers: %d, body: %s, will try again later\n", res.StatusCode, readBody(res.Body))
-		return false
+	for _, peer := range peers {
+		if peer.ID != identity.PeerID.String() {
+			continue
+		}
+		fmt.Println("Already peered with main node, checking if valid multiaddress")
+		if len(peer.MultiAddress) == 0 {
+			return false, fmt.Errorf("multiaddress not found in peer corresponding to this node (%s) in get peers response", peer.ID)
+		}
+		fullMultiInMain := peer.MultiAddress[0] + "/p2p/" + peer.ID
+		if fullMultiInMain == identity.Multiaddress {
+			return true, nil
+		}
+		fmt.Printf("Multiaddress in main node is stale (my (%s) != in main (%s)), deleting old peering\n", identity.Multiaddress, fullMultiInMain)
+		deleteCtx, deleteCancel := context.WithTimeout(context.Background(), callTimeout)
+		start = time.Now()
+		err := client.RemovePeer(deleteCtx, peer.ID)
+		httpRequestDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+		deleteCancel()
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to delete old peering on main pod %s", mainPod.Name)
+		}
+		peeringStaleDeletionsTotal.Inc()
+		fmt.Println("Old peering deleted")
 	}
-	fmt.Println("Peering established")
-	return true
-}
 
-func readBody(bodyReader io.Reader) string {
-	bodyBytes, err := io.ReadAll(bodyReader)
+	fmt.Printf("Establishing peering with main pod %s\n", mainPod.Name)
+	addCtx, addCancel := context.WithTimeout(context.Background(), callTimeout)
+	start = time.Now()
+	_, err = client.AddPeer(addCtx, identity.Multiaddress, myNodeName)
+	httpRequestDuration.WithLabelValues("add").Observe(time.Since(start).Seconds())
+	addCancel()
 	if err != nil {
-		return "Failed to read body: " + err.Error()
-	} else {
-		return string(bodyBytes)
-	}
-}
-
-func getMultiaddressFromPeer(peer map[string]interface{}) (string, bool) {
-	raw, ok := peer["multiAddress"]
-	if !ok {
-		return "", false
-	}
-	list, ok := raw.([]interface{})
-	if !ok || len(list) == 0 {
-		return "", false
-	}
-	str, ok := list[0].(string)
-	if !ok {
-		return "", false
+		return false, errors.Wrapf(err, "failed to add peer against main pod %s", mainPod.Name)
 	}
-	return str, true
+	fmt.Printf("Peering with main pod %s established\n", mainPod.Name)
+	return true, nil
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	reconcileTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "peering_reconcile_total",
+		Help: "Total number of peering reconciliation attempts against a main hornet pod, by result.",
+	}, []string{"result"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "peering_http_request_duration_seconds",
+		Help:    "Duration of HTTP requests made against the HORNET REST API, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+
+	peeringCurrentEstablished = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "peering_current_established",
+		Help: "Number of main hornet pods we are currently successfully peered with.",
+	})
+
+	peeringStaleDeletionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "peering_stale_deletions_total",
+		Help: "Total number of stale peerings deleted from main hornet pods.",
+	})
+
+	k8sPodListErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "k8s_pod_list_errors_total",
+		Help: "Total number of errors listing k8s pods while reconciling peerings.",
+	})
+)
+
+// serveMetrics exposes Prometheus metrics plus /healthz and /readyz. Both
+// report unhealthy unless at least minPeers targets in sched are currently
+// peered - the same count /status computes (see serveStatus) - rather than
+// merely "some target reconciled successfully at some point", which would
+// report healthy even with only 1 of minPeers required mains ever peered.
+func serveMetrics(addr string, sched *scheduler, minPeers int) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	healthHandler := func(w http.ResponseWriter, r *http.Request) {
+		peered := countPeered(sched.snapshot())
+		if peered >= minPeers {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "only %d/%d required main hornet pods currently peered\n", peered, minPeers)
+	}
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", healthHandler)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("metrics endpoint stopped: %s\n", err.Error())
+	}
+}
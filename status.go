@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// targetState tracks the reconciliation state of a single main hornet pod
+// we peer against. It is exported via the /status endpoint so operators can
+// see, per target, whether the mesh is actually converging.
+type targetState struct {
+	PodName     string    `json:"podName"`
+	PodIP       string    `json:"podIp"`
+	Peered      bool      `json:"peered"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// scheduler keeps per-target peering state in memory, so that a target
+// backing off after a failed attempt never blocks reconciliation of the
+// others: reconcileTarget only attempts a target once scheduler.ready says so.
+type scheduler struct {
+	mu      sync.Mutex
+	targets map[string]*targetState
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{targets: make(map[string]*targetState)}
+}
+
+// ready reports whether podName's next scheduled attempt is due.
+func (s *scheduler) ready(podName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.targets[podName]
+	if !ok {
+		return true
+	}
+	return !time.Now().Before(state.NextAttempt)
+}
+
+func (s *scheduler) recordSuccess(podName, podIP string, refreshPeriod time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.targets[podName] = &targetState{
+		PodName:     podName,
+		PodIP:       podIP,
+		Peered:      true,
+		LastAttempt: now,
+		NextAttempt: now.Add(refreshPeriod),
+	}
+}
+
+func (s *scheduler) recordFailure(podName, podIP, errMsg string, retryPeriod time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.targets[podName] = &targetState{
+		PodName:     podName,
+		PodIP:       podIP,
+		Peered:      false,
+		LastError:   errMsg,
+		LastAttempt: now,
+		NextAttempt: now.Add(retryPeriod),
+	}
+}
+
+// remove drops a single target's state, e.g. once its pod has been deleted.
+func (s *scheduler) remove(podName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.targets, podName)
+}
+
+// countTracked returns how many targets currently have state recorded.
+func (s *scheduler) countTracked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.targets)
+}
+
+// isTracked reports whether podName already has state recorded.
+func (s *scheduler) isTracked(podName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.targets[podName]
+	return ok
+}
+
+func (s *scheduler) snapshot() []targetState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]targetState, 0, len(s.targets))
+	for _, state := range s.targets {
+		out = append(out, *state)
+	}
+	return out
+}
+
+type statusResponse struct {
+	MinPeers    int           `json:"minPeers"`
+	PeeredCount int           `json:"peeredCount"`
+	Targets     []targetState `json:"targets"`
+}
+
+// serveStatus exposes the current per-target peering state on /status so
+// operators can tell whether the sidecar is actually converging against
+// every main hornet pod it's supposed to.
+func serveStatus(addr string, sched *scheduler, minPeers int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		targets := sched.snapshot()
+		peered := 0
+		for _, t := range targets {
+			if t.Peered {
+				peered++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statusResponse{
+			MinPeers:    minPeers,
+			PeeredCount: peered,
+			Targets:     targets,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("status endpoint stopped: %s\n", err.Error())
+	}
+}